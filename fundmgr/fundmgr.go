@@ -0,0 +1,176 @@
+package fundmgr
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// FundManagerNode is the chain-facing surface FundMgr needs: reading escrow
+// state and sending/waiting on an AddFunds message.
+type FundManagerNode interface {
+	GetBalance(ctx context.Context, addr address.Address) (storagemarket.Balance, error)
+	AddFunds(ctx context.Context, addr address.Address, amount abi.TokenAmount) (cid.Cid, error)
+	WaitForMessage(ctx context.Context, mcid cid.Cid) error
+}
+
+// topUpBatchWindow is how long a topUp batch stays open for other concurrent
+// shortfalls against the same address to join before a single AddFunds
+// message is sent covering all of them.
+const topUpBatchWindow = 10 * time.Millisecond
+
+// topUp batches the shortfalls of every Reserve call that joined it into a
+// single AddFunds message, and fans its result out to each of them.
+type topUp struct {
+	amt     abi.TokenAmount
+	waiters []chan error
+	mcid    cid.Cid
+}
+
+// addrFunds is one address's reservation ledger, plus the topUp batch
+// currently collecting shortfalls for it, if any. Its own lock means a
+// reservation against one address never blocks a reservation against
+// another.
+type addrFunds struct {
+	lk       sync.Mutex
+	reserved abi.TokenAmount
+	topUp    *topUp
+}
+
+// FundMgr reserves client collateral and storage price against escrow ahead
+// of signing a deal proposal, coalescing any shortfall across concurrent
+// reservations into a single AddFunds message per address.
+type FundMgr struct {
+	node FundManagerNode
+
+	lk    sync.Mutex
+	funds map[address.Address]*addrFunds
+}
+
+// NewFundMgr constructs a FundMgr backed by node.
+func NewFundMgr(node FundManagerNode) *FundMgr {
+	return &FundMgr{
+		node:  node,
+		funds: map[address.Address]*addrFunds{},
+	}
+}
+
+func (fm *FundMgr) addrFunds(addr address.Address) *addrFunds {
+	fm.lk.Lock()
+	defer fm.lk.Unlock()
+	af, ok := fm.funds[addr]
+	if !ok {
+		af = &addrFunds{reserved: big.Zero()}
+		fm.funds[addr] = af
+	}
+	return af
+}
+
+// Reserve ensures addr has at least amt of unreserved escrow available,
+// topping up with a single AddFunds message -- shared with any other
+// shortfall against addr that arrives within the same batching window -- if
+// the current balance falls short. After each top up it re-checks the
+// balance, and tops up again in a new batch if other reservations used up
+// the headroom in the meantime. It returns the cid of the last such message
+// waited on, or cid.Undef if no top up was needed.
+func (fm *FundMgr) Reserve(ctx context.Context, addr address.Address, amt abi.TokenAmount) (cid.Cid, error) {
+	af := fm.addrFunds(addr)
+
+	var lastTopUp cid.Cid
+	for {
+		af.lk.Lock()
+		balance, err := fm.node.GetBalance(ctx, addr)
+		if err != nil {
+			af.lk.Unlock()
+			return cid.Undef, xerrors.Errorf("getting escrow balance for %s: %w", addr, err)
+		}
+
+		available := big.Sub(big.Sub(balance.Escrow, balance.Locked), af.reserved)
+		if available.GreaterThanEqual(amt) {
+			af.reserved = big.Add(af.reserved, amt)
+			af.lk.Unlock()
+			return lastTopUp, nil
+		}
+
+		shortfall := big.Sub(amt, available)
+		if af.topUp == nil {
+			af.topUp = &topUp{amt: big.Zero()}
+			// runTopUp is shared by every Reserve call that joins this
+			// batch, so it must not run on any single one of their
+			// contexts -- canceling the caller that happened to create the
+			// batch would otherwise fail AddFunds/WaitForMessage for every
+			// other caller waiting on it too.
+			go fm.runTopUp(context.Background(), addr, af.topUp)
+		}
+		batch := af.topUp
+		batch.amt = big.Add(batch.amt, shortfall)
+		waiter := make(chan error, 1)
+		batch.waiters = append(batch.waiters, waiter)
+		af.lk.Unlock()
+
+		if err := <-waiter; err != nil {
+			return cid.Undef, err
+		}
+		lastTopUp = batch.mcid
+
+		// af.lk was released for the chain round trip above, so another
+		// Reserve call may have taken the fast path in the meantime and
+		// consumed the headroom this top up was meant to cover. Loop back
+		// around and re-check the now-current balance and af.reserved under
+		// the lock before committing this reservation, instead of trusting
+		// the shortfall computed before we waited.
+	}
+}
+
+// runTopUp keeps batch open for topUpBatchWindow so concurrent shortfalls
+// against the same address can add their demand to it, then sends a single
+// AddFunds covering the batch's total and wakes every Reserve call waiting on
+// it. The address's addrFunds.topUp is cleared before the message is sent, so
+// any shortfall arriving after the window starts a fresh batch rather than
+// blocking behind this one's chain round trip.
+func (fm *FundMgr) runTopUp(ctx context.Context, addr address.Address, batch *topUp) {
+	time.Sleep(topUpBatchWindow)
+
+	af := fm.addrFunds(addr)
+	af.lk.Lock()
+	amt := batch.amt
+	if af.topUp == batch {
+		af.topUp = nil
+	}
+	af.lk.Unlock()
+
+	mcid, err := fm.node.AddFunds(ctx, addr, amt)
+	if err == nil {
+		err = fm.node.WaitForMessage(ctx, mcid)
+	}
+	if err != nil {
+		err = xerrors.Errorf("adding funds to escrow for %s: %w", addr, err)
+	}
+
+	batch.mcid = mcid
+	for _, w := range batch.waiters {
+		w <- err
+	}
+}
+
+// Release gives back amt of addr's reserved escrow, e.g. after a deal fails
+// before the funds it reserved were actually locked on chain.
+func (fm *FundMgr) Release(addr address.Address, amt abi.TokenAmount) {
+	af := fm.addrFunds(addr)
+	af.lk.Lock()
+	defer af.lk.Unlock()
+
+	remaining := big.Sub(af.reserved, amt)
+	if remaining.LessThan(big.Zero()) {
+		remaining = big.Zero()
+	}
+	af.reserved = remaining
+}
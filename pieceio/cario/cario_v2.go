@@ -0,0 +1,85 @@
+package cario
+
+import (
+	"context"
+	"io"
+
+	commpwriter "github.com/filecoin-project/go-commp-utils/writer"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/ipld/go-ipld-prime"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/filestore"
+	"github.com/filecoin-project/go-fil-markets/pieceio"
+)
+
+// carIOV2 wraps the CARv1 writer with CARv2 pragma/header/index generation.
+type carIOV2 struct {
+	pieceio.CarIO
+}
+
+// NewCarIOV2 returns a CarIOV2 that writes CARv2 piece files -- a CARv1
+// payload wrapped in a pragma/header and followed by an index -- instead of
+// bare CARv1 streams.
+func NewCarIOV2() pieceio.CarIOV2 {
+	return &carIOV2{NewCarIO()}
+}
+
+func (c *carIOV2) WriteCarV2(ctx context.Context, bs pieceio.ReadStore, store filestore.FileStore, payloadCid cid.Cid, node ipld.Node, path filestore.Path, userOnNewCarBlocks ...car.OnNewCarBlockFunc) (filestore.Path, cid.Cid, abi.UnpaddedPieceSize, error) {
+	// The CARv1 payload is written to its own filestore-managed temp file --
+	// which WrapV1File below needs as a plain file -- while a commP writer
+	// observes the same bytes, so the piece commitment matches what a
+	// CARv1-only participant would compute for this DAG, not the CARv2
+	// container WrapV1File produces from it.
+	v1f, err := store.CreateTemp()
+	if err != nil {
+		return "", cid.Undef, 0, err
+	}
+	v1Path := v1f.Path()
+	defer func() { _ = store.Delete(v1Path) }()
+
+	w := &commpwriter.Writer{}
+	err = c.CarIO.WriteCar(ctx, bs, payloadCid, node, io.MultiWriter(v1f, w), userOnNewCarBlocks...)
+	closeErr := v1f.Close()
+	if err != nil {
+		return "", cid.Undef, 0, err
+	}
+	if closeErr != nil {
+		return "", cid.Undef, 0, closeErr
+	}
+
+	dataCIDSize, err := w.Sum()
+	if err != nil {
+		return "", cid.Undef, 0, err
+	}
+
+	if err := carv2.WrapV1File(string(v1Path), string(path)); err != nil {
+		return "", cid.Undef, 0, xerrors.Errorf("wrapping CARv1 payload into a CARv2 piece: %w", err)
+	}
+
+	idx, err := carv2.GenerateIndex(string(path))
+	if err != nil {
+		return "", cid.Undef, 0, xerrors.Errorf("generating CARv2 piece index: %w", err)
+	}
+
+	idxf, err := store.CreateTemp()
+	if err != nil {
+		return "", cid.Undef, 0, err
+	}
+	idxPath := idxf.Path()
+	if _, err := index.WriteTo(idx, idxf); err != nil {
+		idxf.Close()
+		_ = store.Delete(idxPath)
+		return "", cid.Undef, 0, xerrors.Errorf("writing piece index side-car: %w", err)
+	}
+	if err := idxf.Close(); err != nil {
+		_ = store.Delete(idxPath)
+		return "", cid.Undef, 0, err
+	}
+
+	return idxPath, dataCIDSize.PieceCID, dataCIDSize.PieceSize.Unpadded(), nil
+}
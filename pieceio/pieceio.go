@@ -5,16 +5,17 @@ import (
 	"github.com/filecoin-project/go-fil-markets/tools/dlog/dfilmarketlog"
 	"go.uber.org/zap"
 	"io"
-	"os"
-	"sync"
 
+	commpwriter "github.com/filecoin-project/go-commp-utils/writer"
 	"github.com/filecoin-project/go-padreader"
 	"github.com/filecoin-project/sector-storage/ffiwrapper"
 	"github.com/filecoin-project/specs-actors/actors/abi"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipld/go-car"
+	carv2blockstore "github.com/ipld/go-car/v2/blockstore"
 	"github.com/ipld/go-ipld-prime"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-fil-markets/filestore"
 )
@@ -36,6 +37,22 @@ type CarIO interface {
 	LoadCar(bs WriteStore, r io.Reader) (cid.Cid, error)
 }
 
+// CarIOV2 extends CarIO with the ability to write CARv2 piece files --
+// a CARv1 payload wrapped in a pragma/header and followed by an index --
+// so that individual blocks can later be read back out of the piece by
+// seeking, instead of restaging the DAG into a separate blockstore.
+type CarIOV2 interface {
+	CarIO
+
+	// WriteCarV2 writes payloadCid's DAG as a CARv2 file to path, persisting
+	// a standalone .idx file (created through store) at the returned path
+	// mapping every block CID to its offset. The returned commitment and
+	// paddedSize are computed over the CARv1 payload bytes alone, so they
+	// agree with the commP a V1-only participant would compute for the same
+	// DAG, even though the piece on disk is wrapped in a CARv2 container.
+	WriteCarV2(ctx context.Context, bs ReadStore, store filestore.FileStore, payloadCid cid.Cid, node ipld.Node, path filestore.Path, userOnNewCarBlocks ...car.OnNewCarBlockFunc) (idxPath filestore.Path, commitment cid.Cid, paddedSize abi.UnpaddedPieceSize, err error)
+}
+
 type pieceIO struct {
 	carIO CarIO
 	bs    blockstore.Blockstore
@@ -54,42 +71,37 @@ func NewPieceIOWithStore(carIO CarIO, store filestore.FileStore, bs blockstore.B
 	return &pieceIOWithStore{pieceIO{carIO, bs}, store}
 }
 
+// GeneratePieceCommitment computes the piece CID and padded size for payloadCid
+// by streaming the CAR directly into a commP writer, rather than the historic
+// PrepareCar/Dump-over-an-os.Pipe hand-off between a background goroutine and
+// ffiwrapper. rt is unused here -- the commP writer computes the same digest
+// regardless of sector size -- but is kept on the signature for PieceIO
+// interface stability with existing callers (e.g. clientutils.CommP) and
+// parity with the seal-proof-specific GeneratePieceCommitment free function
+// below.
 func (pio *pieceIO) GeneratePieceCommitment(rt abi.RegisteredSealProof, payloadCid cid.Cid, selector ipld.Node) (cid.Cid, abi.UnpaddedPieceSize, error) {
-	preparedCar, err := pio.carIO.PrepareCar(context.Background(), pio.bs, payloadCid, selector)
-	if err != nil {
+	return pio.GeneratePieceCommitmentStream(rt, payloadCid, selector)
+}
+
+// GeneratePieceCommitmentStream writes the CAR for payloadCid straight into a
+// streaming commP writer, so CAR generation and commP computation happen in a
+// single pass with no pipe, temp file, or extra goroutine. See
+// GeneratePieceCommitment for why rt is accepted but unused.
+func (pio *pieceIO) GeneratePieceCommitmentStream(rt abi.RegisteredSealProof, payloadCid cid.Cid, selector ipld.Node) (cid.Cid, abi.UnpaddedPieceSize, error) {
+	w := &commpwriter.Writer{}
+	if err := pio.carIO.WriteCar(context.Background(), pio.bs, payloadCid, selector, w); err != nil {
 		return cid.Undef, 0, err
 	}
-	pieceSize := uint64(preparedCar.Size())
-	r, w, err := os.Pipe()
+	dataCIDSize, err := w.Sum()
 	if err != nil {
 		return cid.Undef, 0, err
 	}
-	var stop sync.WaitGroup
-	stop.Add(1)
-	var werr error
-	go func() {
-		defer stop.Done()
-		werr = preparedCar.Dump(w)
-		err := w.Close()
-		if werr == nil && err != nil {
-			werr = err
-		}
-	}()
-	commitment, paddedSize, err := GeneratePieceCommitment(rt, r, pieceSize)
-	closeErr := r.Close()
-	if err != nil {
-		return cid.Undef, 0, err
-	}
-	if closeErr != nil {
-		return cid.Undef, 0, closeErr
-	}
-	stop.Wait()
-	if werr != nil {
-		return cid.Undef, 0, werr
-	}
-	return commitment, paddedSize, nil
+	return dataCIDSize.PieceCID, dataCIDSize.PieceSize.Unpadded(), nil
 }
 
+// GeneratePieceCommitmentToFile behaves like GeneratePieceCommitmentStream but
+// additionally persists the CAR to a piece file. See GeneratePieceCommitment
+// for why rt is accepted but unused.
 func (pio *pieceIOWithStore) GeneratePieceCommitmentToFile(rt abi.RegisteredSealProof, payloadCid cid.Cid, selector ipld.Node, userOnNewCarBlocks ...car.OnNewCarBlockFunc) (cid.Cid, filestore.Path, abi.UnpaddedPieceSize, error) {
 	f, err := pio.store.CreateTemp()
 	if err != nil {
@@ -101,24 +113,74 @@ func (pio *pieceIOWithStore) GeneratePieceCommitmentToFile(rt abi.RegisteredSeal
 		_ = pio.store.Delete(f.Path())
 	}
 	// pio.bs 就是 staging，payloadCid 就是 datacid，f 就是 piece file store（temp）。这里就是将 staging 中的数据转换成 piece，temp文件类似 fstmp657539688
-	err = pio.carIO.WriteCar(context.Background(), pio.bs, payloadCid, selector, f, userOnNewCarBlocks...)
+	// The CAR bytes are fanned out to the piece file and the commP writer at the
+	// same time, so disk write and commP computation share the single WriteCar pass.
+	w := &commpwriter.Writer{}
+	err = pio.carIO.WriteCar(context.Background(), pio.bs, payloadCid, selector, io.MultiWriter(f, w), userOnNewCarBlocks...)
 	if err != nil {
 		cleanup()
 		return cid.Undef, "", 0, err
 	}
-	pieceSize := uint64(f.Size())
-	_, err = f.Seek(0, io.SeekStart)
+	dataCIDSize, err := w.Sum()
 	if err != nil {
 		cleanup()
 		return cid.Undef, "", 0, err
 	}
-	commitment, paddedSize, err := GeneratePieceCommitment(rt, f, pieceSize)
+	_ = f.Close()
+	return dataCIDSize.PieceCID, f.Path(), dataCIDSize.PieceSize.Unpadded(), nil
+}
+
+// GeneratePieceCommitmentToFileV2 behaves like GeneratePieceCommitmentToFile,
+// but persists the piece as a CARv2 file plus a side-car .idx file instead of
+// a bare CARv1 stream, so a provider can keep the unsealed piece as its
+// canonical store and serve retrieval reads by seeking into it by CID. The
+// returned commitment is computed over the CARv1 payload alone -- not the
+// CARv2 container -- so it agrees with the commP a client proposing the same
+// DAG over plain CARv1 (GeneratePieceCommitmentToFile) would compute.
+func (pio *pieceIOWithStore) GeneratePieceCommitmentToFileV2(payloadCid cid.Cid, selector ipld.Node, userOnNewCarBlocks ...car.OnNewCarBlockFunc) (cid.Cid, filestore.Path, filestore.Path, abi.UnpaddedPieceSize, error) {
+	carIOV2, ok := pio.carIO.(CarIOV2)
+	if !ok {
+		return cid.Undef, "", "", 0, xerrors.New("configured CarIO does not support CARv2")
+	}
+
+	f, err := pio.store.CreateTemp()
 	if err != nil {
+		return cid.Undef, "", "", 0, err
+	}
+	dfilmarketlog.L.Debug("GeneratePieceCommitmentToFileV2", zap.String("data cid", payloadCid.String()), zap.String("f.Path()", string(f.Path())))
+	piecePath := f.Path()
+	var idxPath filestore.Path
+	cleanup := func() {
+		_ = pio.store.Delete(piecePath)
+		if idxPath != "" {
+			_ = pio.store.Delete(idxPath)
+		}
+	}
+	if err := f.Close(); err != nil {
 		cleanup()
-		return cid.Undef, "", 0, err
+		return cid.Undef, "", "", 0, err
 	}
-	_ = f.Close()
-	return commitment, f.Path(), paddedSize, nil
+
+	var commitment cid.Cid
+	var paddedSize abi.UnpaddedPieceSize
+	idxPath, commitment, paddedSize, err = carIOV2.WriteCarV2(context.Background(), pio.bs, pio.store, payloadCid, selector, piecePath, userOnNewCarBlocks...)
+	if err != nil {
+		cleanup()
+		return cid.Undef, "", "", 0, err
+	}
+
+	return commitment, piecePath, idxPath, paddedSize, nil
+}
+
+// ReadPieceV2 opens a read-only blockstore backed by a CARv2 piece's embedded
+// index, so individual blocks can be served by seeking into the piece rather
+// than loading the whole DAG into an in-memory blockstore.
+func ReadPieceV2(r io.ReaderAt) (blockstore.Blockstore, error) {
+	robs, err := carv2blockstore.NewReadOnly(r, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("opening CARv2 piece as a blockstore: %w", err)
+	}
+	return robs, nil
 }
 
 func GeneratePieceCommitment(rt abi.RegisteredSealProof, rd io.Reader, pieceSize uint64) (cid.Cid, abi.UnpaddedPieceSize, error) {
@@ -2,6 +2,8 @@ package storageimpl
 
 import (
 	"context"
+	"io"
+	"os"
 	"sync"
 
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
@@ -9,19 +11,32 @@ import (
 
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipldformat "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-ipld-prime"
+
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/ipfs/go-unixfs/importer/trickle"
+
+	blockservice "github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	logging "github.com/ipfs/go-log/v2"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-fil-markets/filestore"
+	"github.com/filecoin-project/go-fil-markets/fundmgr"
 	"github.com/filecoin-project/go-fil-markets/pieceio"
 	"github.com/filecoin-project/go-fil-markets/pieceio/cario"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/discovery"
+	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/clientstates"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/clientutils"
@@ -44,15 +59,27 @@ type Client struct {
 	dataTransfer datatransfer.Manager
 	bs           blockstore.Blockstore
 	fs           filestore.FileStore
+	carIO        pieceio.CarIO
 	pio          pieceio.PieceIO
 	discovery    *discovery.Local
 
-	node storagemarket.StorageClientNode
+	node    storagemarket.StorageClientNode
+	fundMgr *fundmgr.FundMgr
 
 	statemachines fsm.Group
 
 	connsLk sync.RWMutex
 	conns   map[cid.Cid]network.StorageDealStream
+
+	// reservedLk guards reserved, the ledger of exactly what ProposeStorageDeal
+	// reserved against fundMgr for each in-flight deal, keyed by ProposalCid so
+	// it can be released later for exactly what was reserved -- the amount
+	// can't be recovered from the deal proposal itself, since ClientCollateral
+	// is always stored as big.Zero() there.
+	reservedLk sync.Mutex
+	reserved   map[cid.Cid]abi.TokenAmount
+
+	pubSub *shared.PubSub
 }
 
 func NewClient(
@@ -70,11 +97,15 @@ func NewClient(
 		net:          net,
 		dataTransfer: dataTransfer,
 		bs:           bs,
+		carIO:        carIO,
 		pio:          pio,
 		discovery:    discovery,
 		node:         scn,
+		fundMgr:      fundmgr.NewFundMgr(scn),
 
-		conns: map[cid.Cid]network.StorageDealStream{},
+		conns:    map[cid.Cid]network.StorageDealStream{},
+		reserved: map[cid.Cid]abi.TokenAmount{},
+		pubSub:   shared.NewPubSub(clientDealDispatcher),
 	}
 
 	statemachines, err := fsm.New(ds, fsm.Parameters{
@@ -83,6 +114,7 @@ func NewClient(
 		StateKeyField:   "State",
 		Events:          clientstates.ClientEvents,
 		StateEntryFuncs: clientstates.ClientStateEntryFuncs,
+		Notifier:        c.notifySubscribers,
 	})
 	if err != nil {
 		return nil, err
@@ -140,6 +172,109 @@ func (c *Client) GetInProgressDeal(ctx context.Context, cid cid.Cid) (storagemar
 	return out, nil
 }
 
+// GetClientDeal returns a snapshot of the deal identified by proposalCid,
+// including its current FSM state, on-chain DealID and PublishMessage cid
+// once published, piece CID, and last error/message.
+func (c *Client) GetClientDeal(ctx context.Context, proposalCid cid.Cid) (storagemarket.ClientDeal, error) {
+	return c.GetInProgressDeal(ctx, proposalCid)
+}
+
+// clientDealEvent is published on the client's pubSub every time a deal's FSM
+// processes an event, so SubscribeToEvents subscribers can react to state
+// transitions instead of polling GetInProgressDeal/GetClientDeal.
+type clientDealEvent struct {
+	event storagemarket.ClientEvent
+	deal  storagemarket.ClientDeal
+}
+
+func clientDealDispatcher(evt shared.Event, subFn shared.SubscriberFn) error {
+	ie, ok := evt.(clientDealEvent)
+	if !ok {
+		return xerrors.New("wrong type of event")
+	}
+	cb, ok := subFn.(func(storagemarket.ClientEvent, storagemarket.ClientDeal))
+	if !ok {
+		return xerrors.New("wrong type of callback")
+	}
+	cb(ie.event, ie.deal)
+	return nil
+}
+
+func (c *Client) notifySubscribers(eventName fsm.EventName, state fsm.StateType) {
+	evt, ok := eventName.(storagemarket.ClientEvent)
+	if !ok {
+		log.Errorf("client FSM notifier: expected storagemarket.ClientEvent, got %T", eventName)
+		return
+	}
+	deal, ok := state.(storagemarket.ClientDeal)
+	if !ok {
+		log.Errorf("client FSM notifier: expected storagemarket.ClientDeal, got %T", state)
+		return
+	}
+	if err := c.pubSub.Publish(clientDealEvent{evt, deal}); err != nil {
+		log.Errorf("failed to publish client deal event: %s", err)
+	}
+
+	switch deal.State {
+	case storagemarket.StorageDealFundsEnsured, storagemarket.StorageDealError:
+		// Either the deal's funds are now accounted for as Locked on chain
+		// instead of merely reserved (StorageDealFundsEnsured), or the deal
+		// failed before they ever got there (StorageDealError) -- either way
+		// fundMgr's reserved tally must stop counting them, or it double
+		// counts every successful deal against Locked forever after. The FSM
+		// can notify more than once while a deal sits in one of these
+		// states, but releaseDealFunds is idempotent: it deletes the
+		// reservation on first release, so a repeat notification finds
+		// nothing left to release.
+		c.releaseDealFunds(deal)
+	}
+}
+
+// releaseDealFunds gives back exactly what ProposeStorageDeal reserved for
+// deal, called once its FSM reaches StorageDealFundsEnsured (funds now
+// Locked on chain instead) or the terminal StorageDealError state, so the
+// reservation ledger doesn't keep counting funds twice or grow unbounded
+// across failed deals. It looks the amount up by ProposalCid rather than
+// recomputing it from deal.ClientDealProposal.Proposal, since
+// ClientCollateral is always zeroed out there and can't tell us what was
+// actually reserved. The lookup also makes this safe to call more than once
+// for the same deal: after the first release the entry is gone, so a
+// duplicate notification finds nothing left to release instead of
+// releasing twice.
+func (c *Client) releaseDealFunds(deal storagemarket.ClientDeal) {
+	c.reservedLk.Lock()
+	amt, ok := c.reserved[deal.ProposalCid]
+	if ok {
+		delete(c.reserved, deal.ProposalCid)
+	}
+	c.reservedLk.Unlock()
+	if !ok {
+		return
+	}
+	c.ReleaseFunds(deal.ClientDealProposal.Proposal.Client, amt)
+}
+
+// forgetReservation releases a reservation ProposeStorageDeal made for
+// proposalCid and drops it from the ledger. It's used on the error paths
+// after the reservation is recorded but before the deal's FSM is far enough
+// along to ever reach StorageDealError itself -- ProposeStorageDeal is
+// returning before sending any more events, so releaseDealFunds would never
+// otherwise run for it.
+func (c *Client) forgetReservation(proposalCid cid.Cid, client address.Address, amt abi.TokenAmount) {
+	c.reservedLk.Lock()
+	delete(c.reserved, proposalCid)
+	c.reservedLk.Unlock()
+	c.ReleaseFunds(client, amt)
+}
+
+// SubscribeToEvents registers cb to be called every time a client deal's FSM
+// processes an event -- published, sealing, active, failed, and so on -- so
+// callers don't have to poll GetInProgressDeal/GetClientDeal to react to
+// state transitions.
+func (c *Client) SubscribeToEvents(cb func(event storagemarket.ClientEvent, deal storagemarket.ClientDeal)) shared.Unsubscribe {
+	return shared.Unsubscribe(c.pubSub.Subscribe(cb))
+}
+
 func (c *Client) GetAsk(ctx context.Context, info storagemarket.StorageProviderInfo) (*storagemarket.SignedStorageAsk, error) {
 	s, err := c.net.NewAskStream(info.PeerID)
 	if err != nil {
@@ -187,6 +322,15 @@ func (c *Client) ProposeStorageDeal(
 		return nil, xerrors.Errorf("computing commP failed: %w", err)
 	}
 
+	// total is exactly what gets reserved below and exactly what must come
+	// back out on every path that doesn't end with the deal's FSM left
+	// running to release it itself via releaseDealFunds.
+	totalPrice := big.Mul(price, big.NewInt(int64(endEpoch-startEpoch)))
+	total := big.Add(collateral, totalPrice)
+	if _, err := c.ReserveFunds(ctx, addr, total); err != nil {
+		return nil, xerrors.Errorf("reserving deal funds failed: %w", err)
+	}
+
 	dealProposal := market.DealProposal{
 		PieceCID:             commP,
 		PieceSize:            pieceSize.Padded(),
@@ -201,11 +345,13 @@ func (c *Client) ProposeStorageDeal(
 
 	clientDealProposal, err := c.node.SignProposal(ctx, addr, dealProposal)
 	if err != nil {
+		c.ReleaseFunds(addr, total)
 		return nil, xerrors.Errorf("signing deal proposal failed: %w", err)
 	}
 
 	proposalNd, err := cborutil.AsIpld(clientDealProposal)
 	if err != nil {
+		c.ReleaseFunds(addr, total)
 		return nil, xerrors.Errorf("getting proposal node failed: %w", err)
 	}
 
@@ -218,13 +364,23 @@ func (c *Client) ProposeStorageDeal(
 		DataRef:            data,
 	}
 
+	// Recorded once the proposal CID exists so releaseDealFunds can find it
+	// however the deal ends: off the FSM's own StorageDealError notification
+	// once it's running, or forgotten directly below if setup fails before
+	// the FSM is driven any further.
+	c.reservedLk.Lock()
+	c.reserved[deal.ProposalCid] = total
+	c.reservedLk.Unlock()
+
 	err = c.statemachines.Begin(proposalNd.Cid(), deal)
 	if err != nil {
+		c.forgetReservation(deal.ProposalCid, addr, total)
 		return nil, xerrors.Errorf("setting up deal tracking: %w", err)
 	}
 
 	s, err := c.net.NewDealStream(info.PeerID)
 	if err != nil {
+		c.forgetReservation(deal.ProposalCid, addr, total)
 		return nil, xerrors.Errorf("connecting to storage provider failed: %w", err)
 	}
 	c.connsLk.Lock()
@@ -233,6 +389,7 @@ func (c *Client) ProposeStorageDeal(
 
 	err = c.statemachines.Send(deal.ProposalCid, storagemarket.ClientEventOpen)
 	if err != nil {
+		c.forgetReservation(deal.ProposalCid, addr, total)
 		return nil, xerrors.Errorf("initializing state machine: %w", err)
 	}
 
@@ -252,6 +409,102 @@ func (c *Client) AddPaymentEscrow(ctx context.Context, addr address.Address, amo
 	return c.node.AddFunds(ctx, addr, amount)
 }
 
+// ReserveFunds ensures addr has at least amt of unreserved escrow available
+// ahead of signing a deal proposal, topping up escrow through AddFunds if
+// needed; more than one message is sent when concurrent reservations use up
+// the first top up. It returns the cid of the last such message waited on,
+// or cid.Undef if escrow already covered amt.
+func (c *Client) ReserveFunds(ctx context.Context, addr address.Address, amt abi.TokenAmount) (cid.Cid, error) {
+	return c.fundMgr.Reserve(ctx, addr, amt)
+}
+
+// ReleaseFunds gives back amt of addr's reserved escrow, e.g. when a deal
+// fails in a terminal state before its reserved funds were ever locked.
+func (c *Client) ReleaseFunds(addr address.Address, amt abi.TokenAmount) {
+	c.fundMgr.Release(addr, amt)
+}
+
+// Layout selects the shape of the UnixFS DAG Import builds.
+type Layout int
+
+const (
+	// BalancedLayout arranges leaves under a fixed-width tree of intermediate
+	// nodes. It's the default layout used by most UnixFS tooling.
+	BalancedLayout Layout = iota
+	// TrickleLayout favors fast access to the start of the file, at the cost
+	// of a less balanced tree.
+	TrickleLayout
+)
+
+// ImportOptions configures how Import chunks and builds the UnixFS DAG for a
+// local file.
+type ImportOptions struct {
+	// ChunkSize is the maximum size, in bytes, of each UnixFS leaf. Zero uses
+	// the chunker package's default size.
+	ChunkSize int64
+	// RawLeaves stores leaf data as raw blocks instead of wrapping each leaf
+	// in a UnixFS protobuf node.
+	RawLeaves bool
+	// CidBuilder overrides the CID version/multihash used for generated
+	// nodes. Nil uses the DAG service's default.
+	CidBuilder cid.Builder
+	// Layout selects the shape of the generated DAG.
+	Layout Layout
+	// NoCopy is passed to the UnixFS DAG builder as is. Import hands that
+	// builder a plain opened file, which carries no filestore path
+	// reference, so with NoCopy set Import fails while setting up the DAG
+	// builder; leaf data is not referenced in place on disk.
+	NoCopy bool
+}
+
+// Import chunks the file at path into a UnixFS DAG stored in c.bs using the
+// chunker/layout selected by opts, and returns the DAG's root CID. The
+// returned CID can be handed directly to ProposeStorageDeal as DataRef.Root.
+func (c *Client) Import(ctx context.Context, path string, opts ImportOptions) (cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("opening file to import: %w", err)
+	}
+	defer f.Close()
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = chunker.DefaultBlockSize
+	}
+
+	dagService := merkledag.NewDAGService(blockservice.New(c.bs, offline.Exchange(c.bs)))
+	dbp := ihelper.DagBuilderParams{
+		Dagserv:    dagService,
+		RawLeaves:  opts.RawLeaves,
+		CidBuilder: opts.CidBuilder,
+		NoCopy:     opts.NoCopy,
+		Maxlinks:   ihelper.DefaultLinksPerBlock,
+	}
+
+	db, err := dbp.New(chunker.NewSizeSplitter(f, chunkSize))
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("setting up DAG builder: %w", err)
+	}
+
+	var nd ipldformat.Node
+	if opts.Layout == TrickleLayout {
+		nd, err = trickle.Layout(db)
+	} else {
+		nd, err = balanced.Layout(db)
+	}
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("building UnixFS DAG: %w", err)
+	}
+
+	return nd.Cid(), nil
+}
+
+// ExportCar writes the DAG rooted at root, as selected by selector, to w as a
+// CAR file so it can be materialized offline before being proposed as a deal.
+func (c *Client) ExportCar(ctx context.Context, root cid.Cid, w io.Writer, selector ipld.Node) error {
+	return c.carIO.WriteCar(ctx, c.bs, root, selector, w)
+}
+
 type clientDealEnvironment struct {
 	c *Client
 }